@@ -0,0 +1,97 @@
+// Package certs provisions self-signed device identities for gateways that
+// authenticate to the ingest API over mTLS, and derives the fingerprint the
+// server uses as that device's identity.
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Fingerprint returns the lowercase hex SHA-256 fingerprint of a certificate,
+// used as that certificate's device_id.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateSelfSigned creates a self-signed cert/key pair for deviceID so a
+// gateway can authenticate via mTLS without an external PKI, writing
+// <deviceID>.crt and <deviceID>.key into outDir. It returns the resulting
+// fingerprint, which is what the server will see as the device's identity -
+// note this is NOT deviceID itself, since the fingerprint depends on the
+// generated key; print it so the caller can register the matching device_id.
+func GenerateSelfSigned(deviceID, outDir string) (fingerprint string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", fmt.Errorf("generate serial: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: deviceID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", fmt.Errorf("create certificate: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", fmt.Errorf("parse generated certificate: %w", err)
+	}
+
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return "", fmt.Errorf("create output dir: %w", err)
+	}
+
+	certPath := filepath.Join(outDir, deviceID+".crt")
+	keyPath := filepath.Join(outDir, deviceID+".key")
+
+	certOut, err := os.Create(certPath)
+	if err != nil {
+		return "", fmt.Errorf("create %s: %w", certPath, err)
+	}
+	defer certOut.Close()
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		return "", fmt.Errorf("write %s: %w", certPath, err)
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", fmt.Errorf("marshal private key: %w", err)
+	}
+
+	keyOut, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("create %s: %w", keyPath, err)
+	}
+	defer keyOut.Close()
+	if err := pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}); err != nil {
+		return "", fmt.Errorf("write %s: %w", keyPath, err)
+	}
+
+	return Fingerprint(cert), nil
+}
@@ -0,0 +1,69 @@
+// Package models holds the GORM-tagged row types that back the devices,
+// commands, events and packets tables. AutoMigrate keeps these in sync with
+// the schema, so a fresh database needs no hand-written DDL.
+package models
+
+import "time"
+
+// Device is a registered gateway/sensor and its rolling connection stats.
+type Device struct {
+	DeviceID       string `gorm:"column:device_id;primaryKey" json:"device_id"`
+	Name           string `gorm:"column:name" json:"name"`
+	Location       string `gorm:"column:location" json:"location"`
+	SensorType     string `gorm:"column:sensor_type" json:"sensor_type"`
+	LastRSSI       int16  `gorm:"column:last_rssi" json:"last_rssi"`
+	LastSNR        int16  `gorm:"column:last_snr" json:"last_snr"`
+	PacketCount    int32  `gorm:"column:packet_count" json:"packet_count"`
+	LastSequence   int32  `gorm:"column:last_sequence" json:"last_sequence"`
+	SensorInterval int16  `gorm:"column:sensor_interval" json:"sensor_interval"`
+	DeepSleepSec   int16  `gorm:"column:deep_sleep_sec" json:"deep_sleep_sec"`
+
+	LastSeen  time.Time `gorm:"column:last_seen" json:"last_seen"`
+	CreatedAt time.Time `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+	UpdatedAt time.Time `gorm:"column:updated_at;autoUpdateTime" json:"updated_at"`
+}
+
+func (Device) TableName() string { return "devices" }
+
+// Command is a downlink command queued for, sent to, or acked by a device.
+type Command struct {
+	ID          string `gorm:"column:id;primaryKey" json:"id"`
+	DeviceID    string `gorm:"column:device_id;index" json:"device_id"`
+	CommandType int16  `gorm:"column:command_type" json:"command_type"`
+	Parameters  string `gorm:"column:parameters" json:"parameters"`
+	Status      string `gorm:"column:status;index" json:"status"`
+	LatencyMS   *int64 `gorm:"column:latency_ms" json:"latency_ms"`
+
+	CreatedAt time.Time `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+}
+
+func (Command) TableName() string { return "commands" }
+
+// Event is a device-reported event (error, reboot, low battery, etc.).
+type Event struct {
+	ID        uint   `gorm:"column:id;primaryKey" json:"id"`
+	DeviceID  string `gorm:"column:device_id;index" json:"device_id"`
+	EventType int16  `gorm:"column:event_type" json:"event_type"`
+	Severity  int16  `gorm:"column:severity" json:"severity"`
+	Message   string `gorm:"column:message" json:"message"`
+
+	ReceivedAt time.Time `gorm:"column:received_at;autoCreateTime" json:"received_at"`
+}
+
+func (Event) TableName() string { return "events" }
+
+// Packet is a single ingested LoRa frame, deduped on (device_id, sequence_num).
+type Packet struct {
+	ID          uint   `gorm:"column:id;primaryKey" json:"id"`
+	DeviceID    string `gorm:"column:device_id;uniqueIndex:idx_packets_device_seq" json:"device_id"`
+	GatewayID   string `gorm:"column:gateway_id" json:"gateway_id"`
+	MsgType     int16  `gorm:"column:msg_type" json:"msg_type"`
+	SequenceNum int32  `gorm:"column:sequence_num;uniqueIndex:idx_packets_device_seq" json:"sequence_num"`
+	RSSI        int16  `gorm:"column:rssi" json:"rssi"`
+	SNR         int16  `gorm:"column:snr" json:"snr"`
+	Payload     []byte `gorm:"column:payload;type:jsonb" json:"payload"`
+
+	ReceivedAt time.Time `gorm:"column:received_at;autoCreateTime" json:"received_at"`
+}
+
+func (Packet) TableName() string { return "packets" }
@@ -0,0 +1,217 @@
+// Package mqtt subscribes to per-device LoRa topics and feeds ingested
+// packets into the time-series store, keeping the device registry's rolling
+// stats in sync the same way the HTTP registry endpoint does.
+package mqtt
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"gorm.io/gorm"
+
+	"github.com/aachtenberg/esp32-lora-gateway/internal/models"
+	"github.com/aachtenberg/esp32-lora-gateway/internal/store"
+)
+
+// Config holds the broker connection details, normally sourced from env vars.
+type Config struct {
+	Broker   string
+	Topic    string
+	ClientID string
+	Username string
+	Password string
+}
+
+// ConfigFromEnv builds a Config from MQTT_BROKER/MQTT_TOPIC/MQTT_USER/MQTT_PASSWORD,
+// falling back to sane local-broker defaults.
+func ConfigFromEnv() Config {
+	return Config{
+		Broker:   envOr("MQTT_BROKER", "tcp://localhost:1883"),
+		Topic:    envOr("MQTT_TOPIC", "lora/+/data"),
+		ClientID: envOr("MQTT_CLIENT_ID", "gateway-api"),
+		Username: envOr("MQTT_USER", ""),
+		Password: envOr("MQTT_PASSWORD", ""),
+	}
+}
+
+func envOr(key, defaultValue string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+// Ingester owns the MQTT connection and writes every received packet into db.
+type Ingester struct {
+	cfg    Config
+	db     *gorm.DB
+	client paho.Client
+}
+
+// New builds an Ingester and its underlying MQTT client synchronously, so
+// Publish is safe to call as soon as New returns even if Start (which does
+// the actual network dialing) hasn't been scheduled yet. Call Start to
+// connect and begin subscribing.
+func New(db *gorm.DB, cfg Config) *Ingester {
+	g := &Ingester{cfg: cfg, db: db}
+
+	opts := paho.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(false).  // we drive reconnection ourselves, below
+		SetAutoAckDisabled(true). // we ack by hand, only once the store write lands
+		SetOnConnectHandler(func(c paho.Client) {
+			log.Printf("mqtt: connected to %s", g.cfg.Broker)
+			if token := c.Subscribe(g.cfg.Topic, 1, g.handleMessage); token.Wait() && token.Error() != nil {
+				log.Printf("mqtt: failed to subscribe to %s: %v", g.cfg.Topic, token.Error())
+			}
+			if token := c.Subscribe("lora/+/ack/+", 1, g.handleAck); token.Wait() && token.Error() != nil {
+				log.Printf("mqtt: failed to subscribe to command acks: %v", token.Error())
+			}
+		}).
+		SetConnectionLostHandler(func(c paho.Client, err error) {
+			log.Printf("mqtt: connection lost: %v", err)
+			go g.reconnect()
+		})
+
+	g.client = paho.NewClient(opts)
+	return g
+}
+
+// Start connects to the broker with exponential backoff and subscribes to
+// cfg.Topic. It blocks, retrying without limit, until the initial
+// connection succeeds; later connection losses are retried in the
+// background. Callers should run it in a goroutine.
+func (g *Ingester) Start() error {
+	return g.connectWithBackoff()
+}
+
+// connectWithBackoff retries Connect with capped exponential backoff and
+// jitter so a flapping broker doesn't get hammered.
+func (g *Ingester) connectWithBackoff() error {
+	backoff := time.Second
+	const maxBackoff = 30 * time.Second
+
+	for {
+		token := g.client.Connect()
+		token.Wait()
+		if token.Error() == nil {
+			return nil
+		}
+
+		log.Printf("mqtt: connect failed, retrying in %s: %v", backoff, token.Error())
+		time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff)/2+1)))
+		if backoff < maxBackoff {
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+func (g *Ingester) reconnect() {
+	if err := g.connectWithBackoff(); err != nil {
+		log.Printf("mqtt: giving up reconnecting: %v", err)
+	}
+}
+
+// handleMessage unmarshals a frame published on lora/<device_id>/data,
+// writes it to the time-series store (deduped on sequence number) and
+// refreshes the device registry. The message is only acked once the write
+// has landed, giving at-least-once delivery semantics end to end.
+func (g *Ingester) handleMessage(_ paho.Client, msg paho.Message) {
+	deviceID := deviceIDFromTopic(msg.Topic())
+	if deviceID == "" {
+		log.Printf("mqtt: could not parse device id from topic %q", msg.Topic())
+		return
+	}
+
+	var frame struct {
+		DeviceID    string          `json:"device_id"`
+		GatewayID   string          `json:"gateway_id"`
+		MsgType     int16           `json:"msg_type"`
+		SequenceNum int32           `json:"sequence_num"`
+		RSSI        int16           `json:"rssi"`
+		SNR         int16           `json:"snr"`
+		Payload     json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(msg.Payload(), &frame); err != nil {
+		log.Printf("mqtt: invalid packet payload on %s: %v", msg.Topic(), err)
+		return
+	}
+	if frame.DeviceID == "" {
+		frame.DeviceID = deviceID
+	}
+
+	rec := models.Packet{
+		DeviceID:    frame.DeviceID,
+		GatewayID:   frame.GatewayID,
+		MsgType:     frame.MsgType,
+		SequenceNum: frame.SequenceNum,
+		RSSI:        frame.RSSI,
+		SNR:         frame.SNR,
+		Payload:     []byte(frame.Payload),
+	}
+
+	inserted, err := store.InsertPacket(g.db, rec)
+	if err != nil {
+		log.Printf("mqtt: failed to store packet for %s: %v", rec.DeviceID, err)
+		return
+	}
+	if !inserted {
+		// Already seen this (device_id, sequence_num) - QoS 1 redelivery.
+		msg.Ack()
+		return
+	}
+
+	if err := store.UpsertDeviceFromPacket(g.db, rec); err != nil {
+		log.Printf("mqtt: failed to update device registry for %s: %v", rec.DeviceID, err)
+		return
+	}
+
+	msg.Ack()
+}
+
+// deviceIDFromTopic pulls <device_id> out of a lora/<device_id>/data topic.
+func deviceIDFromTopic(topic string) string {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// Publish sends a downlink command payload to lora/<device_id>/cmd. It
+// waits for the publish to complete so callers can tell "sent" from
+// "queued but broker unreachable".
+func (g *Ingester) Publish(deviceID string, payload []byte) error {
+	topic := "lora/" + deviceID + "/cmd"
+	token := g.client.Publish(topic, 1, false, payload)
+	token.Wait()
+	return token.Error()
+}
+
+// handleAck processes lora/<device_id>/ack/<cmd_id> messages and updates the
+// matching command's lifecycle state in the store.
+func (g *Ingester) handleAck(_ paho.Client, msg paho.Message) {
+	parts := strings.Split(msg.Topic(), "/")
+	if len(parts) < 4 {
+		log.Printf("mqtt: could not parse command id from ack topic %q", msg.Topic())
+		return
+	}
+	cmdID := parts[3]
+
+	if err := store.AckCommand(g.db, cmdID); err != nil {
+		log.Printf("mqtt: failed to record ack for command %s: %v", cmdID, err)
+		return
+	}
+	msg.Ack()
+}
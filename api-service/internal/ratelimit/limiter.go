@@ -0,0 +1,90 @@
+// Package ratelimit implements a per-IP token-bucket rate limiter backed by
+// an LRU so a burst of misbehaving gateways can't grow the bucket map
+// without bound.
+package ratelimit
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maxTrackedIPs bounds memory use; the least-recently-seen IP is evicted
+// once the limiter is tracking more than this many buckets at once.
+const maxTrackedIPs = 10000
+
+type bucket struct {
+	tokens     float64
+	lastRefill time.Time
+	elem       *list.Element
+}
+
+// Limiter is a token-bucket rate limiter keyed by remote IP. Tokens refill
+// continuously at avgPerWindow/window and a request is allowed as long as
+// the bucket holds at least one token, up to burst capacity.
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	lru     *list.List // front = most recently used
+
+	refillPerSec float64
+	burst        float64
+	window       time.Duration
+}
+
+// New builds a Limiter allowing avgPerWindow requests per window on average,
+// with bursts up to burst requests.
+func New(avgPerWindow, burst int, window time.Duration) *Limiter {
+	return &Limiter{
+		buckets:      make(map[string]*bucket),
+		lru:          list.New(),
+		refillPerSec: float64(avgPerWindow) / window.Seconds(),
+		burst:        float64(burst),
+		window:       window,
+	}
+}
+
+// Allow reports whether a request from ip is allowed, and if not, how long
+// the caller should wait before retrying.
+func (l *Limiter) Allow(ip string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: l.burst, lastRefill: now}
+		b.elem = l.lru.PushFront(ip)
+		l.buckets[ip] = b
+		l.evictIfNeededLocked()
+	} else {
+		l.lru.MoveToFront(b.elem)
+	}
+
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	b.tokens += elapsed * l.refillPerSec
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.lastRefill = now
+
+	if b.tokens < 1 {
+		deficit := 1 - b.tokens
+		retryAfter := time.Duration(deficit/l.refillPerSec*1000) * time.Millisecond
+		return false, retryAfter
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+func (l *Limiter) evictIfNeededLocked() {
+	for len(l.buckets) > maxTrackedIPs {
+		oldest := l.lru.Back()
+		if oldest == nil {
+			return
+		}
+		l.lru.Remove(oldest)
+		delete(l.buckets, oldest.Value.(string))
+	}
+}
@@ -0,0 +1,263 @@
+// Package store holds the GORM queries shared between the HTTP API and the
+// MQTT ingester so both paths keep devices/packets/commands/events
+// consistent.
+package store
+
+import (
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/aachtenberg/esp32-lora-gateway/internal/models"
+)
+
+// Command lifecycle states, tracked from creation through to the device's
+// acknowledgement (or timeout/cancellation).
+const (
+	CommandQueued  = "queued"
+	CommandSent    = "sent"
+	CommandAcked   = "acked"
+	CommandFailed  = "failed"
+	CommandExpired = "expired"
+)
+
+// AutoMigrate brings a fresh database up to date with the models, so
+// Postgres, SQLite and MySQL all become usable with no manual DDL.
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(&models.Device{}, &models.Command{}, &models.Event{}, &models.Packet{})
+}
+
+// EnsureHypertable converts the packets table into a TimescaleDB hypertable.
+// It's a no-op error on plain Postgres, so failures are logged, not fatal.
+func EnsureHypertable(db *gorm.DB) {
+	if err := db.Exec(`SELECT create_hypertable('packets', 'received_at', if_not_exists => TRUE)`).Error; err != nil {
+		log.Printf("store: create_hypertable skipped (not running TimescaleDB?): %v", err)
+	}
+}
+
+// EnsureNotifyTriggers installs the pg_notify trigger used to fan events out
+// to WebSocket clients. It (re)creates the trigger function and attaches it
+// to devices/commands/events so every insert or update publishes on the
+// "iot_events" channel. Postgres-only.
+func EnsureNotifyTriggers(db *gorm.DB) error {
+	return db.Exec(`
+		CREATE OR REPLACE FUNCTION notify_iot_event() RETURNS TRIGGER AS $$
+		DECLARE
+			payload JSON;
+		BEGIN
+			payload := json_build_object(
+				'table', TG_TABLE_NAME,
+				'device_id', NEW.device_id,
+				'event_type', (row_to_json(NEW)->>'event_type')::int,
+				'row', row_to_json(NEW)
+			);
+			PERFORM pg_notify('iot_events', payload::text);
+			RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		DROP TRIGGER IF EXISTS devices_notify_iot_event ON devices;
+		CREATE TRIGGER devices_notify_iot_event AFTER INSERT OR UPDATE ON devices
+			FOR EACH ROW EXECUTE FUNCTION notify_iot_event();
+
+		DROP TRIGGER IF EXISTS commands_notify_iot_event ON commands;
+		CREATE TRIGGER commands_notify_iot_event AFTER INSERT OR UPDATE ON commands
+			FOR EACH ROW EXECUTE FUNCTION notify_iot_event();
+
+		DROP TRIGGER IF EXISTS events_notify_iot_event ON events;
+		CREATE TRIGGER events_notify_iot_event AFTER INSERT OR UPDATE ON events
+			FOR EACH ROW EXECUTE FUNCTION notify_iot_event();
+	`).Error
+}
+
+// UpsertDevice inserts or updates a device's registry row, mirroring what
+// devicesHandler used to do with a hand-written ON CONFLICT. Timestamps are
+// computed here in Go and bound as parameters rather than left to a SQL
+// NOW(), since DB_DRIVER can point this at Postgres, SQLite or MySQL and
+// only the first of those understands NOW().
+func UpsertDevice(db *gorm.DB, d models.Device) error {
+	now := time.Now()
+	d.LastSeen = now
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "device_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"name":            d.Name,
+			"location":        d.Location,
+			"sensor_type":     d.SensorType,
+			"last_rssi":       d.LastRSSI,
+			"last_snr":        d.LastSNR,
+			"packet_count":    d.PacketCount,
+			"last_sequence":   d.LastSequence,
+			"sensor_interval": d.SensorInterval,
+			"deep_sleep_sec":  d.DeepSleepSec,
+			"last_seen":       now,
+			"updated_at":      now,
+		}),
+	}).Create(&d).Error
+}
+
+// UpsertDeviceFromPacket refreshes the device registry's rolling stats from
+// an ingested packet. For a device already in the registry it only touches
+// the columns a bare packet can tell us about, leaving name/location alone;
+// a device first seen via MQTT is created with its device ID as its name.
+func UpsertDeviceFromPacket(db *gorm.DB, p models.Packet) error {
+	now := time.Now()
+	device := models.Device{
+		DeviceID:     p.DeviceID,
+		Name:         p.DeviceID,
+		LastRSSI:     p.RSSI,
+		LastSNR:      p.SNR,
+		PacketCount:  1,
+		LastSequence: p.SequenceNum,
+		LastSeen:     now,
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "device_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"last_rssi":     p.RSSI,
+			"last_snr":      p.SNR,
+			"packet_count":  gorm.Expr("devices.packet_count + 1"),
+			"last_sequence": p.SequenceNum,
+			"last_seen":     now,
+			"updated_at":    now,
+		}),
+	}).Create(&device).Error
+}
+
+// InsertPacket writes a packet row, deduping on (device_id, sequence_num)
+// so at-least-once MQTT delivery doesn't double-count readings. It reports
+// whether a new row was actually inserted.
+func InsertPacket(db *gorm.DB, p models.Packet) (bool, error) {
+	result := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "device_id"}, {Name: "sequence_num"}},
+		DoNothing: true,
+	}).Create(&p)
+	return result.RowsAffected > 0, result.Error
+}
+
+// ListPackets returns packets for the /api/packets read endpoint, optionally
+// filtered by device and a received_at window.
+func ListPackets(db *gorm.DB, deviceID, from, to string, limit int) ([]models.Packet, error) {
+	q := db.Model(&models.Packet{})
+	if deviceID != "" {
+		q = q.Where("device_id = ?", deviceID)
+	}
+	if from != "" {
+		q = q.Where("received_at >= ?", from)
+	}
+	if to != "" {
+		q = q.Where("received_at <= ?", to)
+	}
+
+	var packets []models.Packet
+	err := q.Order("received_at DESC").Limit(limit).Find(&packets).Error
+	return packets, err
+}
+
+// InsertCommand inserts a new command in the "queued" state, keyed by a
+// caller-generated UUID so the MQTT downlink payload and the DB row agree on
+// an identifier before it's ever published.
+func InsertCommand(db *gorm.DB, id, deviceID string, commandType int16, parameters string) error {
+	return db.Create(&models.Command{
+		ID:          id,
+		DeviceID:    deviceID,
+		CommandType: commandType,
+		Parameters:  parameters,
+		Status:      CommandQueued,
+	}).Error
+}
+
+// UpdateCommandStatus transitions a command to a new status, e.g. "sent"
+// once published or "failed" if dispatch errors out.
+func UpdateCommandStatus(db *gorm.DB, id, status string) error {
+	return db.Model(&models.Command{}).Where("id = ?", id).Update("status", status).Error
+}
+
+// AckCommand marks a command acked and records its round-trip latency. The
+// latency is computed in Go from the command's created_at rather than via a
+// Postgres-only EXTRACT(EPOCH FROM ...), since DB_DRIVER can also be sqlite
+// or mysql.
+func AckCommand(db *gorm.DB, id string) error {
+	var cmd models.Command
+	if err := db.Select("created_at").Where("id = ?", id).First(&cmd).Error; err != nil {
+		return err
+	}
+
+	latencyMS := time.Since(cmd.CreatedAt).Milliseconds()
+	return db.Model(&models.Command{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":     CommandAcked,
+		"latency_ms": latencyMS,
+	}).Error
+}
+
+// ExpireStaleCommands transitions "sent" commands that have been waiting
+// longer than ttl to "expired", so operators can tell "still waiting on the
+// device" apart from "device never acked it". It reports how many rows were
+// expired.
+func ExpireStaleCommands(db *gorm.DB, ttl time.Duration) (int64, error) {
+	cutoff := time.Now().Add(-ttl)
+	result := db.Model(&models.Command{}).
+		Where("status = ? AND created_at < ?", CommandSent, cutoff).
+		Update("status", CommandExpired)
+	return result.RowsAffected, result.Error
+}
+
+// CancelQueuedCommand deletes a command that hasn't been dispatched yet. It
+// reports whether a row was actually removed; false covers both "already
+// dispatched" and "never existed", which it does not tell apart.
+func CancelQueuedCommand(db *gorm.DB, id string) (bool, error) {
+	result := db.Where("id = ? AND status = ?", id, CommandQueued).Delete(&models.Command{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// ListCommands returns commands for the /api/commands read endpoint,
+// optionally filtered by device and/or status.
+func ListCommands(db *gorm.DB, deviceID, status string) ([]models.Command, error) {
+	q := db.Model(&models.Command{})
+	if deviceID != "" {
+		q = q.Where("device_id = ?", deviceID)
+	}
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+
+	var commands []models.Command
+	err := q.Order("created_at DESC").Find(&commands).Error
+	return commands, err
+}
+
+// InsertEvent records a device-reported event.
+func InsertEvent(db *gorm.DB, e models.Event) error {
+	return db.Create(&e).Error
+}
+
+// EventWithDeviceName is an event joined against the device registry for the
+// /api/events read endpoint, which has always shown the device's name
+// alongside its ID.
+type EventWithDeviceName struct {
+	ID         uint   `json:"id"`
+	DeviceID   string `json:"device_id"`
+	DeviceName string `json:"device_name"`
+	EventType  int16  `json:"event_type"`
+	Severity   int16  `json:"severity"`
+	Message    string `json:"message"`
+	ReceivedAt string `json:"received_at"`
+}
+
+// ListEventsWithDeviceName returns the most recent events, left-joined
+// against devices for a friendly name. This join doesn't map onto a single
+// model, so it's expressed as a raw query rather than a Model(...).Find(...).
+func ListEventsWithDeviceName(db *gorm.DB, limit int) ([]EventWithDeviceName, error) {
+	var events []EventWithDeviceName
+	err := db.Raw(`
+		SELECT e.id, e.device_id, COALESCE(d.name, 'Unknown') AS device_name,
+		       e.event_type, e.severity, e.message, e.received_at
+		FROM events e
+		LEFT JOIN devices d ON e.device_id = d.device_id
+		ORDER BY e.received_at DESC
+		LIMIT ?
+	`, limit).Scan(&events).Error
+	return events, err
+}
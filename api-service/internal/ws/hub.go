@@ -0,0 +1,204 @@
+// Package ws fans out Postgres LISTEN/NOTIFY events to WebSocket clients so
+// the UI no longer has to poll /api/events.
+package ws
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+)
+
+const (
+	sendBufferSize = 16
+	writeWait      = 10 * time.Second
+	pingInterval   = 30 * time.Second
+	pongWait       = 60 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Notification is the payload published by the notify_iot_event() trigger
+// on INSERT/UPDATE into devices, commands or events.
+type Notification struct {
+	Table     string          `json:"table"`
+	DeviceID  string          `json:"device_id"`
+	EventType *int            `json:"event_type"`
+	Row       json.RawMessage `json:"row"`
+}
+
+// client is a single subscriber, optionally filtered by device_id/event_type.
+type client struct {
+	conn            *websocket.Conn
+	send            chan []byte
+	deviceFilter    string
+	eventTypeFilter string
+}
+
+// Hub tracks connected clients and broadcasts notifications to the ones
+// whose filters match.
+type Hub struct {
+	mu      sync.Mutex
+	clients map[*client]bool
+}
+
+// NewHub creates an empty Hub.
+func NewHub() *Hub {
+	return &Hub{clients: make(map[*client]bool)}
+}
+
+// Listen opens a github.com/lib/pq.Listener on the iot_events channel and
+// broadcasts every notification it receives until the process exits. Run it
+// in its own goroutine.
+func (h *Hub) Listen(connStr string) error {
+	reportProblem := func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("ws: listener error: %v", err)
+		}
+	}
+
+	listener := pq.NewListener(connStr, 10*time.Second, time.Minute, reportProblem)
+	if err := listener.Listen("iot_events"); err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		select {
+		case n := <-listener.Notify:
+			if n == nil {
+				continue // reconnected; pq.Listener resent LISTEN for us
+			}
+			h.broadcast([]byte(n.Extra))
+		case <-time.After(90 * time.Second):
+			go listener.Ping()
+		}
+	}
+}
+
+// broadcast delivers a raw notification payload to every client whose
+// device_id/event_type filters match. Clients whose send buffer is full are
+// dropped rather than allowed to block the fan-out.
+func (h *Hub) broadcast(payload []byte) {
+	var n Notification
+	if err := json.Unmarshal(payload, &n); err != nil {
+		log.Printf("ws: could not parse notification: %v", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if c.deviceFilter != "" && c.deviceFilter != n.DeviceID {
+			continue
+		}
+		if c.eventTypeFilter != "" && (n.EventType == nil || c.eventTypeFilter != eventTypeString(*n.EventType)) {
+			continue
+		}
+		select {
+		case c.send <- payload:
+		default:
+			log.Printf("ws: client send buffer full, disconnecting")
+			h.removeLocked(c)
+			close(c.send)
+			c.conn.Close()
+		}
+	}
+}
+
+func (h *Hub) add(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = true
+}
+
+func (h *Hub) remove(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(c)
+}
+
+func (h *Hub) removeLocked(c *client) {
+	delete(h.clients, c)
+}
+
+func eventTypeString(n int) string {
+	return strconv.Itoa(n)
+}
+
+// ServeWS upgrades the request to a WebSocket and streams device/event/command
+// notifications, optionally filtered by the device_id and event_type query
+// params.
+func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("ws: upgrade failed: %v", err)
+		return
+	}
+
+	c := &client{
+		conn:            conn,
+		send:            make(chan []byte, sendBufferSize),
+		deviceFilter:    r.URL.Query().Get("device_id"),
+		eventTypeFilter: r.URL.Query().Get("event_type"),
+	}
+	h.add(c)
+
+	go h.writePump(c)
+	go h.readPump(c)
+}
+
+// readPump only exists to notice the client going away (we don't accept
+// inbound messages); it also enforces the pong deadline.
+func (h *Hub) readPump(c *client) {
+	defer func() {
+		h.remove(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func (h *Hub) writePump(c *client) {
+	ticker := time.NewTicker(pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
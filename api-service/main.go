@@ -1,23 +1,44 @@
 package main
 
 import (
-	"database/sql"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
-
-	_ "github.com/lib/pq"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/aachtenberg/esp32-lora-gateway/internal/certs"
+	"github.com/aachtenberg/esp32-lora-gateway/internal/models"
+	"github.com/aachtenberg/esp32-lora-gateway/internal/mqtt"
+	"github.com/aachtenberg/esp32-lora-gateway/internal/ratelimit"
+	"github.com/aachtenberg/esp32-lora-gateway/internal/store"
+	"github.com/aachtenberg/esp32-lora-gateway/internal/ws"
 )
 
 type Config struct {
 	Port       string
+	DBDriver   string
 	DBHost     string
 	DBPort     string
 	DBUser     string
 	DBPassword string
 	DBName     string
+	CertFile   string
+	KeyFile    string
+	ClientCA   string
 }
 
 type DevicePayload struct {
@@ -57,35 +78,112 @@ type EventPayload struct {
 	Message   string `json:"message"`
 }
 
-var db *sql.DB
+var db *gorm.DB
+var ingester *mqtt.Ingester
+var hub *ws.Hub
+var mtlsEnabled bool
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gen-cert" {
+		genCertCmd(os.Args[2:])
+		return
+	}
+
+	certFile := flag.String("cert", getEnv("TLS_CERT_FILE", ""), "TLS certificate file (enables HTTPS)")
+	keyFile := flag.String("key", getEnv("TLS_KEY_FILE", ""), "TLS private key file (enables HTTPS)")
+	clientCA := flag.String("client-ca", getEnv("TLS_CLIENT_CA", ""), "CA bundle for verifying client certs (enables mTLS device identity)")
+	limitAvg := flag.Int("limit-avg", getEnvInt("LIMIT_AVG", 20), "average requests allowed per remote IP per 10s window")
+	limitBurst := flag.Int("limit-burst", getEnvInt("LIMIT_BURST", 40), "burst capacity per remote IP")
+	commandTTL := flag.Int("command-ttl", getEnvInt("COMMAND_TTL_SECONDS", 300), "seconds a \"sent\" command may wait for an ack before it's marked expired")
+	debug := flag.Bool("debug", getEnv("DEBUG", "") != "", "log per-request timing")
+	flag.Parse()
+
 	config := Config{
 		Port:       getEnv("PORT", "3000"),
+		DBDriver:   getEnv("DB_DRIVER", "postgres"),
 		DBHost:     getEnv("DB_HOST", "192.168.0.167"),
 		DBPort:     getEnv("DB_PORT", "5432"),
 		DBUser:     getEnv("DB_USER", "sre_agent"),
 		DBPassword: getEnv("DB_PASSWORD", ""),
 		DBName:     getEnv("DB_NAME", "iot_sensors"),
+		CertFile:   *certFile,
+		KeyFile:    *keyFile,
+		ClientCA:   *clientCA,
 	}
+	mtlsEnabled = config.ClientCA != ""
 
-	// Connect to PostgreSQL
+	// connStr is only meaningful for postgres; sqlite/mysql build their own
+	// DSN below. It's also what the WebSocket hub LISTENs on, since
+	// LISTEN/NOTIFY is a Postgres-only feature.
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		config.DBHost, config.DBPort, config.DBUser, config.DBPassword, config.DBName)
 
+	var dialector gorm.Dialector
+	switch config.DBDriver {
+	case "postgres":
+		dialector = postgres.Open(connStr)
+	case "sqlite":
+		dialector = sqlite.Open(getEnv("DB_SQLITE_PATH", config.DBName+".db"))
+	case "mysql":
+		dialector = mysql.Open(fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
+			config.DBUser, config.DBPassword, config.DBHost, config.DBPort, config.DBName))
+	default:
+		log.Fatalf("Unsupported DB_DRIVER %q (want postgres, sqlite or mysql)", config.DBDriver)
+	}
+
 	var err error
-	db, err = sql.Open("postgres", connStr)
+	db, err = gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
 		log.Fatal("Failed to open database:", err)
 	}
-	defer db.Close()
 
-	// Test connection
-	if err := db.Ping(); err != nil {
+	sqlDB, err := db.DB()
+	if err != nil {
+		log.Fatal("Failed to access underlying sql.DB:", err)
+	}
+	defer sqlDB.Close()
+
+	if err := sqlDB.Ping(); err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
+	log.Printf("Connected to %s database", config.DBDriver)
+
+	sqlDB.SetMaxOpenConns(getEnvInt("DB_MAX_OPEN_CONNS", 25))
+	sqlDB.SetMaxIdleConns(getEnvInt("DB_MAX_IDLE_CONNS", 5))
+
+	if err := store.AutoMigrate(db); err != nil {
+		log.Fatal("Failed to auto-migrate schema:", err)
+	}
+
+	hub = ws.NewHub()
+
+	if config.DBDriver == "postgres" {
+		// Packets land in Postgres (optionally a TimescaleDB hypertable) via
+		// the MQTT ingester below, not through an HTTP write endpoint.
+		store.EnsureHypertable(db)
+
+		if err := store.EnsureNotifyTriggers(db); err != nil {
+			log.Printf("ws: failed to install notify triggers: %v", err)
+		}
+		go func() {
+			if err := hub.Listen(connStr); err != nil {
+				log.Printf("ws: listener stopped: %v", err)
+			}
+		}()
+	} else {
+		log.Printf("ws: live updates need LISTEN/NOTIFY, which DB_DRIVER=%s doesn't support; /api/ws will stay idle", config.DBDriver)
+	}
+
+	ingester = mqtt.New(db, mqtt.ConfigFromEnv())
+	go func() {
+		if err := ingester.Start(); err != nil {
+			log.Printf("mqtt: ingester stopped: %v", err)
+		}
+	}()
 
-	log.Printf("Connected to PostgreSQL at %s:%s", config.DBHost, config.DBPort)
+	go expireStaleCommandsLoop(time.Duration(*commandTTL) * time.Second)
+
+	limiter := ratelimit.New(*limitAvg, *limitBurst, 10*time.Second)
 
 	// CORS middleware
 	corsHandler := func(next http.HandlerFunc) http.HandlerFunc {
@@ -101,22 +199,141 @@ func main() {
 		}
 	}
 
+	// rateLimitHandler throttles POST requests per remote IP; GETs (UI
+	// polling/reads) are left alone.
+	rateLimitHandler := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				next(w, r)
+				return
+			}
+			ip := remoteIP(r)
+			if allowed, retryAfter := limiter.Allow(ip); !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+1)))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+			next(w, r)
+		}
+	}
+
+	// debugHandler logs request timing when -debug/DEBUG is set.
+	debugHandler := func(next http.HandlerFunc) http.HandlerFunc {
+		if !*debug {
+			return next
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			next(w, r)
+			log.Printf("debug: %s %s took %s", r.Method, r.URL.Path, time.Since(start))
+		}
+	}
+
+	wrap := func(next http.HandlerFunc) http.HandlerFunc {
+		return debugHandler(corsHandler(rateLimitHandler(next)))
+	}
+
 	// Setup HTTP routes
-	// NOTE: Packets endpoint removed - sensor data goes to MQTT → timeseries DB
-	// This API is for device registry and management only
-	http.HandleFunc("/api/health", corsHandler(healthHandler))
-	http.HandleFunc("/api/devices", corsHandler(devicesHandler))
-	http.HandleFunc("/api/commands", corsHandler(commandsHandler))
-	http.HandleFunc("/api/events", corsHandler(eventsHandler))
+	http.HandleFunc("/api/health", wrap(healthHandler))
+	http.HandleFunc("/api/devices", wrap(devicesHandler))
+	http.HandleFunc("/api/commands", wrap(commandsHandler))
+	http.HandleFunc("/api/commands/", wrap(commandHandler))
+	http.HandleFunc("/api/events", wrap(eventsHandler))
+	http.HandleFunc("/api/packets", wrap(packetsHandler))
+	http.HandleFunc("/api/ws", hub.ServeWS)
 
 	// Start server
 	addr := ":" + config.Port
-	log.Printf("Starting server on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	server := &http.Server{
+		Addr:         addr,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	if config.CertFile == "" || config.KeyFile == "" {
+		log.Printf("Starting server on %s (plain HTTP)", addr)
+		if err := server.ListenAndServe(); err != nil {
+			log.Fatal("Server failed:", err)
+		}
+		return
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.ClientCA != "" {
+		caPEM, err := os.ReadFile(config.ClientCA)
+		if err != nil {
+			log.Fatal("Failed to read client CA: ", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			log.Fatal("Failed to parse client CA bundle")
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		log.Printf("mTLS enabled: device identity derived from client cert fingerprint")
+	}
+	server.TLSConfig = tlsConfig
+
+	log.Printf("Starting server on %s (HTTPS)", addr)
+	if err := server.ListenAndServeTLS(config.CertFile, config.KeyFile); err != nil {
 		log.Fatal("Server failed:", err)
 	}
 }
 
+// remoteIP extracts the client IP from a request's RemoteAddr, stripping
+// the port if present.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// genCertCmd implements `gateway-api gen-cert [-out dir] <device-id>`,
+// provisioning a self-signed client certificate for a gateway so it can
+// authenticate over mTLS without an external PKI.
+func genCertCmd(args []string) {
+	fs := flag.NewFlagSet("gen-cert", flag.ExitOnError)
+	out := fs.String("out", ".", "directory to write <device-id>.crt/.key into")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: gateway-api gen-cert [-out dir] <device-id>")
+		os.Exit(1)
+	}
+	deviceID := fs.Arg(0)
+
+	fingerprint, err := certs.GenerateSelfSigned(deviceID, *out)
+	if err != nil {
+		log.Fatal("Failed to generate certificate: ", err)
+	}
+
+	fmt.Printf("Wrote %s/%s.{crt,key}\n", *out, deviceID)
+	fmt.Printf("Register this device with device_id=%s (its certificate fingerprint)\n", fingerprint)
+}
+
+// verifyDeviceIdentity checks, when mTLS is enabled, that deviceID matches
+// the fingerprint of the client certificate presented on r. It is a no-op
+// when mTLS is not configured. Only apply this to endpoints a device posts
+// to about itself (registering, reporting an event); /api/commands is
+// posted by an operator dispatching to a device, so the poster's identity
+// is never expected to match deviceID.
+func verifyDeviceIdentity(r *http.Request, deviceID string) error {
+	if !mtlsEnabled {
+		return nil
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return fmt.Errorf("no client certificate presented")
+	}
+	fingerprint := certs.Fingerprint(r.TLS.PeerCertificates[0])
+	if fingerprint != deviceID {
+		return fmt.Errorf("device_id %q does not match client certificate fingerprint %q", deviceID, fingerprint)
+	}
+	return nil
+}
+
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -124,7 +341,8 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check database connection
-	if err := db.Ping(); err != nil {
+	sqlDB, err := db.DB()
+	if err != nil || sqlDB.Ping() != nil {
 		http.Error(w, "Database unavailable", http.StatusServiceUnavailable)
 		return
 	}
@@ -146,33 +364,25 @@ func devicesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// UPSERT device
-	query := `
-		INSERT INTO devices (
-			device_id, name, location, sensor_type, last_rssi, last_snr,
-			packet_count, last_sequence, sensor_interval, deep_sleep_sec,
-			last_seen, updated_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW(), NOW())
-		ON CONFLICT (device_id) DO UPDATE SET
-			name = EXCLUDED.name,
-			location = EXCLUDED.location,
-			sensor_type = EXCLUDED.sensor_type,
-			last_rssi = EXCLUDED.last_rssi,
-			last_snr = EXCLUDED.last_snr,
-			packet_count = EXCLUDED.packet_count,
-			last_sequence = EXCLUDED.last_sequence,
-			sensor_interval = EXCLUDED.sensor_interval,
-			deep_sleep_sec = EXCLUDED.deep_sleep_sec,
-			last_seen = NOW(),
-			updated_at = NOW()
-	`
-
-	_, err := db.Exec(query,
-		payload.DeviceID, payload.Name, payload.Location, payload.SensorType,
-		payload.LastRSSI, payload.LastSNR, payload.PacketCount,
-		payload.LastSequence, payload.SensorInterval, payload.DeepSleepSec)
+	if err := verifyDeviceIdentity(r, payload.DeviceID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
-	if err != nil {
+	device := models.Device{
+		DeviceID:       payload.DeviceID,
+		Name:           payload.Name,
+		Location:       payload.Location,
+		SensorType:     payload.SensorType,
+		LastRSSI:       payload.LastRSSI,
+		LastSNR:        payload.LastSNR,
+		PacketCount:    payload.PacketCount,
+		LastSequence:   payload.LastSequence,
+		SensorInterval: payload.SensorInterval,
+		DeepSleepSec:   payload.DeepSleepSec,
+	}
+
+	if err := store.UpsertDevice(db, device); err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		log.Printf("Failed to upsert device: %v", err)
 		return
@@ -182,10 +392,51 @@ func devicesHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// packetsHandler removed - sensor data goes to MQTT → timeseries DB
-// This API handles device registry and management only
+func packetsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID := r.URL.Query().Get("device_id")
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			limit = n
+		}
+	}
+
+	packets, err := store.ListPackets(db, deviceID, from, to, limit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Failed to fetch packets: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(packets)
+}
 
 func commandsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		deviceID := r.URL.Query().Get("device_id")
+		status := r.URL.Query().Get("status")
+
+		commands, err := store.ListCommands(db, deviceID, status)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			log.Printf("Failed to fetch commands: %v", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(commands)
+		return
+	}
+
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -198,75 +449,103 @@ func commandsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := `
-		INSERT INTO commands (
-			device_id, command_type, parameters, status, created_at
-		) VALUES ($1, $2, $3, $4, NOW())
-	`
+	cmdID := uuid.NewString()
+	if err := store.InsertCommand(db, cmdID, payload.DeviceID, payload.CommandType, payload.Parameters); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		log.Printf("Failed to insert command: %v", err)
+		return
+	}
+
+	downlink, _ := json.Marshal(struct {
+		CommandID   string `json:"command_id"`
+		CommandType int16  `json:"command_type"`
+		Parameters  string `json:"parameters"`
+	}{cmdID, payload.CommandType, payload.Parameters})
 
-	_, err := db.Exec(query,
-		payload.DeviceID, payload.CommandType,
-		payload.Parameters, payload.Status)
+	if err := ingester.Publish(payload.DeviceID, downlink); err != nil {
+		log.Printf("Failed to publish command %s to device %s: %v", cmdID, payload.DeviceID, err)
+		if err := store.UpdateCommandStatus(db, cmdID, store.CommandFailed); err != nil {
+			log.Printf("Failed to mark command %s failed: %v", cmdID, err)
+		}
+		http.Error(w, "Failed to dispatch command", http.StatusBadGateway)
+		return
+	}
+
+	if err := store.UpdateCommandStatus(db, cmdID, store.CommandSent); err != nil {
+		log.Printf("Failed to mark command %s sent: %v", cmdID, err)
+	}
 
+	log.Printf("Command dispatched: id=%s device=%s type=%d", cmdID, payload.DeviceID, payload.CommandType)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		CommandID string `json:"command_id"`
+	}{cmdID})
+}
+
+// commandHandler serves DELETE /api/commands/<id>, canceling a command
+// before it has been dispatched.
+func commandHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/commands/")
+	if id == "" {
+		http.Error(w, "Missing command id", http.StatusBadRequest)
+		return
+	}
+
+	canceled, err := store.CancelQueuedCommand(db, id)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
-		log.Printf("Failed to insert command: %v", err)
+		log.Printf("Failed to cancel command %s: %v", id, err)
+		return
+	}
+	if !canceled {
+		http.Error(w, "Command not found or already dispatched", http.StatusConflict)
 		return
 	}
 
-	log.Printf("Command logged: device=%s type=%d", payload.DeviceID, payload.CommandType)
+	log.Printf("Command canceled: id=%s", id)
 	w.WriteHeader(http.StatusOK)
 }
 
+// expireStaleCommandsLoop periodically sweeps "sent" commands that have
+// waited longer than ttl and marks them "expired", so a device that never
+// acks a downlink doesn't leave it stuck at "sent" forever.
+func expireStaleCommandsLoop(ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired, err := store.ExpireStaleCommands(db, ttl)
+		if err != nil {
+			log.Printf("store: failed to expire stale commands: %v", err)
+			continue
+		}
+		if expired > 0 {
+			log.Printf("store: expired %d stale command(s)", expired)
+		}
+	}
+}
+
 func eventsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		// GET: Fetch recent events
-		limit := r.URL.Query().Get("limit")
-		if limit == "" {
-			limit = "50" // Default to last 50 events
+		limit := 50 // Default to last 50 events
+		if v := r.URL.Query().Get("limit"); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				limit = n
+			}
 		}
 
-		query := `
-			SELECT e.id, e.device_id, d.name, e.event_type, e.severity, e.message, e.received_at
-			FROM events e
-			LEFT JOIN devices d ON e.device_id = d.device_id
-			ORDER BY e.received_at DESC
-			LIMIT $1
-		`
-
-		rows, err := db.Query(query, limit)
+		events, err := store.ListEventsWithDeviceName(db, limit)
 		if err != nil {
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			log.Printf("Failed to fetch events: %v", err)
 			return
 		}
-		defer rows.Close()
-
-		type EventResponse struct {
-			ID         int    `json:"id"`
-			DeviceID   string `json:"device_id"`
-			DeviceName string `json:"device_name"`
-			EventType  int    `json:"event_type"`
-			Severity   int    `json:"severity"`
-			Message    string `json:"message"`
-			ReceivedAt string `json:"received_at"`
-		}
-
-		events := []EventResponse{}
-		for rows.Next() {
-			var e EventResponse
-			var deviceName *string
-			if err := rows.Scan(&e.ID, &e.DeviceID, &deviceName, &e.EventType, &e.Severity, &e.Message, &e.ReceivedAt); err != nil {
-				log.Printf("Error scanning event: %v", err)
-				continue
-			}
-			if deviceName != nil {
-				e.DeviceName = *deviceName
-			} else {
-				e.DeviceName = "Unknown"
-			}
-			events = append(events, e)
-		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(events)
@@ -285,17 +564,19 @@ func eventsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := `
-		INSERT INTO events (
-			device_id, event_type, severity, message, received_at
-		) VALUES ($1, $2, $3, $4, NOW())
-	`
+	if err := verifyDeviceIdentity(r, payload.DeviceID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
-	_, err := db.Exec(query,
-		payload.DeviceID, payload.EventType,
-		payload.Severity, payload.Message)
+	event := models.Event{
+		DeviceID:  payload.DeviceID,
+		EventType: payload.EventType,
+		Severity:  payload.Severity,
+		Message:   payload.Message,
+	}
 
-	if err != nil {
+	if err := store.InsertEvent(db, event); err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		log.Printf("Failed to insert event: %v", err)
 		return
@@ -311,3 +592,12 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}